@@ -4,20 +4,33 @@ import (
 	"bufio"
 	"bytes"
 	"code.google.com/p/go.crypto/ssh"
+	"code.google.com/p/go.crypto/ssh/agent"
+	"code.google.com/p/go.net/context"
 	"errors"
 	"fmt"
 	"github.com/mitchellh/packer/packer"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// ErrHandshakeTimeout is returned by reconnect when the SSH handshake
+// does not complete within Config.HandshakeTimeout, which typically
+// means the TCP connection is half-open.
+var ErrHandshakeTimeout = errors.New("timeout while handshaking with SSH")
+
 type comm struct {
 	client *ssh.ClientConn
 	config *Config
 	conn   net.Conn
+
+	cancelKeepAlive context.CancelFunc
 }
 
 // Config is the structure used to configure the SSH communicator.
@@ -29,6 +42,39 @@ type Config struct {
 	// in use will be closed as part of the Close method, or in the
 	// case an error occurs.
 	Connection func() (net.Conn, error)
+
+	// UseSftp, if true, uses SFTP instead of SCP for file transfers.
+	// SCP remains the default so existing configurations keep working
+	// unmodified.
+	UseSftp bool
+
+	// HandshakeTimeout, if greater than zero, bounds how long the initial
+	// SSH handshake may take. If it isn't complete in time, reconnect
+	// returns ErrHandshakeTimeout instead of hanging on a half-open
+	// connection.
+	HandshakeTimeout time.Duration
+
+	// KeepAliveInterval, if greater than zero, causes a
+	// "keepalive@packer.io" request to be sent on this interval so that
+	// dead connections are detected even when nothing else is using
+	// them.
+	KeepAliveInterval time.Duration
+
+	// MaxKeepAliveDelay is how long to wait for a reply to a keepalive
+	// request before assuming the connection is dead and closing it so
+	// that the next operation triggers a reconnect. Defaults to
+	// KeepAliveInterval if unset.
+	MaxKeepAliveDelay time.Duration
+
+	// Pty, if true, requests a PTY for each remote command. This is off
+	// by default since requesting a PTY breaks non-interactive shells
+	// and sudo configurations that require "!requiretty".
+	Pty bool
+
+	// DisableAgentForwarding, if true, skips forwarding the local SSH
+	// agent (available via SSH_AUTH_SOCK) to the remote host, even when
+	// one is present.
+	DisableAgentForwarding bool
 }
 
 // Creates a new packer.Communicator implementation over SSH. This takes
@@ -58,15 +104,19 @@ func (c *comm) Start(cmd *packer.RemoteCmd) (err error) {
 	session.Stdout = cmd.Stdout
 	session.Stderr = cmd.Stderr
 
-	// Request a PTY
-	termModes := ssh.TerminalModes{
-		ssh.ECHO:          0,     // do not echo
-		ssh.TTY_OP_ISPEED: 14400, // input speed = 14.4kbaud
-		ssh.TTY_OP_OSPEED: 14400, // output speed = 14.4kbaud
-	}
+	// Request a PTY if configured to. Unconditionally requesting one
+	// breaks non-interactive shells and sudo configurations that
+	// require "!requiretty".
+	if c.config.Pty {
+		termModes := ssh.TerminalModes{
+			ssh.ECHO:          0,     // do not echo
+			ssh.TTY_OP_ISPEED: 14400, // input speed = 14.4kbaud
+			ssh.TTY_OP_OSPEED: 14400, // output speed = 14.4kbaud
+		}
 
-	if err = session.RequestPty("xterm", 80, 40, termModes); err != nil {
-		return
+		if err = session.RequestPty("xterm", 80, 40, termModes); err != nil {
+			return
+		}
 	}
 
 	log.Printf("starting remote command: %s", cmd.Command)
@@ -95,7 +145,15 @@ func (c *comm) Start(cmd *packer.RemoteCmd) (err error) {
 	return
 }
 
-func (c *comm) Upload(path string, input io.Reader) error {
+func (c *comm) Upload(path string, input io.Reader, fi *os.FileInfo) error {
+	if c.config.UseSftp {
+		return c.sftpUpload(path, input, fi)
+	}
+
+	return c.scpUpload(path, input, fi)
+}
+
+func (c *comm) scpUpload(path string, input io.Reader, fi *os.FileInfo) error {
 	// The target directory and file for talking the SCP protocol
 	target_dir := filepath.Dir(path)
 	target_file := filepath.Base(path)
@@ -106,33 +164,61 @@ func (c *comm) Upload(path string, input io.Reader) error {
 	target_dir = filepath.ToSlash(target_dir)
 
 	scpFunc := func(w io.Writer, stdoutR *bufio.Reader) error {
-		return scpUploadFile(target_file, input, w, stdoutR)
+		return scpUploadFile(target_file, input, w, stdoutR, fi)
 	}
 
 	return c.scpSession("scp -vt "+target_dir, scpFunc)
 }
 
 func (c *comm) UploadDir(dst string, src string, excl []string) error {
-	f, err := os.Open(src)
-	if err != nil {
-		return err
+	if c.config.UseSftp {
+		return c.sftpUploadDir(dst, src, excl)
 	}
-	defer f.Close()
 
-	entries, err := f.Readdir(-1)
-	if err != nil {
-		return err
-	}
+	return c.scpUploadDir(dst, src, excl)
+}
 
+func (c *comm) scpUploadDir(dst string, src string, excl []string) error {
 	scpFunc := func(w io.Writer, r *bufio.Reader) error {
-		return scpUploadDir(src, entries, w, r)
+		return filepath.Walk(src, scpWalkFn(src, src, excl, w, r))
 	}
 
 	return c.scpSession("scp -rvt "+dst, scpFunc)
 }
 
-func (c *comm) Download(string, io.Writer) error {
-	panic("not implemented yet")
+func (c *comm) Download(src string, dst io.Writer) error {
+	if c.config.UseSftp {
+		return c.sftpDownload(src, dst)
+	}
+
+	return c.scpDownload(src, dst)
+}
+
+func (c *comm) scpDownload(src string, dst io.Writer) error {
+	scpFunc := func(w io.Writer, r *bufio.Reader) error {
+		return scpDownloadFile(dst, w, r)
+	}
+
+	return c.scpSession("scp -vf "+src, scpFunc)
+}
+
+// DownloadDir downloads the directory at src on the remote side to dst
+// on the local side, recreating the directory structure and file
+// permissions as it goes.
+func (c *comm) DownloadDir(src string, dst string) error {
+	if c.config.UseSftp {
+		return c.sftpDownloadDir(src, dst)
+	}
+
+	return c.scpDownloadDir(src, dst)
+}
+
+func (c *comm) scpDownloadDir(src string, dst string) error {
+	scpFunc := func(w io.Writer, r *bufio.Reader) error {
+		return scpDownloadDir(dst, w, r)
+	}
+
+	return c.scpSession("scp -rvf "+src, scpFunc)
 }
 
 func (c *comm) newSession() (session *ssh.Session, err error) {
@@ -149,13 +235,38 @@ func (c *comm) newSession() (session *ssh.Session, err error) {
 			return nil, err
 		}
 
-		return c.client.NewSession()
+		session, err = c.client.NewSession()
+		if err != nil {
+			return nil, err
+		}
 	}
 
+	c.forwardAgent(session)
 	return session, nil
 }
 
+// forwardAgent requests agent forwarding on session so provisioners can
+// use the forwarded keys to reach downstream hosts (e.g. private git
+// remotes) without shipping keys onto the built image. It is a no-op
+// when forwarding is disabled or no local agent is available. Failures
+// are logged rather than returned since forwarding is a convenience, not
+// a hard requirement for the session to function.
+func (c *comm) forwardAgent(session *ssh.Session) {
+	if c.config.DisableAgentForwarding || os.Getenv("SSH_AUTH_SOCK") == "" {
+		return
+	}
+
+	if err := agent.ForwardAgent(session); err != nil {
+		log.Printf("ssh agent forward request error: %s", err)
+	}
+}
+
 func (c *comm) reconnect() (err error) {
+	if c.cancelKeepAlive != nil {
+		c.cancelKeepAlive()
+		c.cancelKeepAlive = nil
+	}
+
 	if c.conn != nil {
 		c.conn.Close()
 	}
@@ -172,14 +283,139 @@ func (c *comm) reconnect() (err error) {
 	}
 
 	log.Printf("handshaking with SSH")
-	c.client, err = ssh.Client(c.conn, c.config.SSHConfig)
+	c.client, err = c.handshake(c.conn)
 	if err != nil {
 		log.Printf("handshake error: %s", err)
+		return
+	}
+
+	if err := c.setupAgentForwarding(); err != nil {
+		log.Printf("ssh agent forwarding setup error: %s", err)
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancelKeepAlive = cancel
+	go c.keepAliveLoop(ctx)
+
 	return
 }
 
+// setupAgentForwarding dials the local SSH agent referenced by
+// SSH_AUTH_SOCK, if any, and wires it up to forward through c.client so
+// that downstream connections opened from the remote host (e.g. to a
+// private git remote) can use the local agent's keys.
+func (c *comm) setupAgentForwarding() error {
+	if c.config.DisableAgentForwarding {
+		return nil
+	}
+
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return nil
+	}
+
+	agentConn, err := net.Dial("unix", sock)
+	if err != nil {
+		return err
+	}
+
+	return agent.ForwardToAgent(c.client, agent.NewClient(agentConn))
+}
+
+// handshake performs the SSH handshake over conn, bounding it by
+// Config.HandshakeTimeout when one is set so that a half-open TCP
+// connection can't hang callers indefinitely.
+func (c *comm) handshake(conn net.Conn) (*ssh.ClientConn, error) {
+	if c.config.HandshakeTimeout <= 0 {
+		return ssh.Client(conn, c.config.SSHConfig)
+	}
+
+	type result struct {
+		client *ssh.ClientConn
+		err    error
+	}
+
+	resultCh := make(chan result, 1)
+	go func() {
+		client, err := ssh.Client(conn, c.config.SSHConfig)
+		resultCh <- result{client, err}
+	}()
+
+	select {
+	case r := <-resultCh:
+		return r.client, r.err
+	case <-time.After(c.config.HandshakeTimeout):
+		return nil, ErrHandshakeTimeout
+	}
+}
+
+// keepAliveLoop periodically sends a "keepalive@packer.io" request on
+// c.client until ctx is cancelled (by Close or a subsequent reconnect).
+// If a reply doesn't arrive within Config.MaxKeepAliveDelay, the
+// underlying connection is closed so that newSession's reconnect logic
+// kicks in on the next use.
+func (c *comm) keepAliveLoop(ctx context.Context) {
+	interval := c.config.KeepAliveInterval
+	if interval <= 0 {
+		return
+	}
+
+	maxDelay := c.config.MaxKeepAliveDelay
+	if maxDelay <= 0 {
+		maxDelay = interval
+	}
+
+	client := c.client
+	conn := c.conn
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			replyCh := make(chan bool, 1)
+			go func() {
+				ok, _, err := client.SendRequest("keepalive@packer.io", true, nil)
+				replyCh <- err == nil && ok
+			}()
+
+			select {
+			case alive := <-replyCh:
+				if !alive {
+					log.Printf("keepalive request failed, closing connection")
+					conn.Close()
+					return
+				}
+			case <-time.After(maxDelay):
+				log.Printf(
+					"no keepalive reply within %s, closing connection", maxDelay)
+				conn.Close()
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// Close terminates the underlying SSH connection, cancelling the
+// keepalive loop started by reconnect.
+func (c *comm) Close() error {
+	if c.cancelKeepAlive != nil {
+		c.cancelKeepAlive()
+		c.cancelKeepAlive = nil
+	}
+
+	if c.conn == nil {
+		return nil
+	}
+
+	return c.conn.Close()
+}
+
 func (c *comm) scpSession(scpCommand string, f func(io.Writer, *bufio.Reader) error) error {
 	session, err := c.newSession()
 	if err != nil {
@@ -258,6 +494,19 @@ func (c *comm) scpSession(scpCommand string, f func(io.Writer, *bufio.Reader) er
 	return nil
 }
 
+// excludeMatch returns true if rel (a path relative to the upload root)
+// matches any of the given exclusion patterns. Patterns are matched with
+// filepath.Match semantics.
+func excludeMatch(rel string, excl []string) bool {
+	for _, pattern := range excl {
+		if ok, _ := filepath.Match(pattern, rel); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
 // checkSCPStatus checks that a prior command sent to SCP completed
 // successfully. If it did not complete successfully, an error will
 // be returned.
@@ -280,61 +529,288 @@ func checkSCPStatus(r *bufio.Reader) error {
 	return nil
 }
 
-func scpUploadFile(dst string, src io.Reader, w io.Writer, r *bufio.Reader) error {
-	// Determine the length of the upload content by copying it
-	// into an in-memory buffer. Note that this means what we upload
-	// must fit into memory.
-	log.Println("Copying input data into in-memory buffer so we can get the length")
-	inputBuf := new(bytes.Buffer)
-	if _, err := io.Copy(inputBuf, src); err != nil {
-		return err
+// scpUploadFile uploads src as dst over an already-started "scp -t"
+// session. When fi is non-nil, its mode and size are used directly so
+// the file streams straight from src without buffering, and its mtime
+// is sent ahead of the file so the remote can preserve it. When fi is
+// nil, the size isn't known up front, so the input is spooled to a temp
+// file on disk (rather than into memory) to determine its length.
+func scpUploadFile(dst string, src io.Reader, w io.Writer, r *bufio.Reader, fi *os.FileInfo) error {
+	mode := os.FileMode(0644)
+	var size int64 = -1
+	var modTime time.Time
+
+	if fi != nil {
+		info := *fi
+		mode = info.Mode().Perm()
+		size = info.Size()
+		modTime = info.ModTime()
+	}
+
+	body := src
+	if size < 0 {
+		log.Println("Size not known up front, spooling input to a temp file to determine it")
+		tf, err := ioutil.TempFile("", "packer-scp-upload")
+		if err != nil {
+			return fmt.Errorf("error creating temp file for upload: %s", err)
+		}
+		defer os.Remove(tf.Name())
+		defer tf.Close()
+
+		size, err = io.Copy(tf, src)
+		if err != nil {
+			return err
+		}
+
+		if _, err := tf.Seek(0, 0); err != nil {
+			return err
+		}
+
+		body = tf
+	}
+
+	if !modTime.IsZero() {
+		mtime := modTime.Unix()
+		fmt.Fprintln(w, "T"+strconv.FormatInt(mtime, 10), "0", strconv.FormatInt(mtime, 10), "0")
+		if err := checkSCPStatus(r); err != nil {
+			return err
+		}
 	}
 
-	// Start the protocol
 	log.Println("Beginning file upload...")
-	fmt.Fprintln(w, "C0644", inputBuf.Len(), dst)
-	err := checkSCPStatus(r)
-	if err != nil {
+	fmt.Fprintln(w, fmt.Sprintf("C%04o", mode), size, dst)
+	if err := checkSCPStatus(r); err != nil {
 		return err
 	}
 
-	if _, err := io.Copy(w, inputBuf); err != nil {
+	if _, err := io.CopyN(w, body, size); err != nil {
 		return err
 	}
 
 	fmt.Fprint(w, "\x00")
-	err = checkSCPStatus(r)
-	if err != nil {
-		return err
+	return checkSCPStatus(r)
+}
+
+// ack sends the single zero byte that the SCP protocol uses to
+// acknowledge a control line or a completed data transfer.
+func ack(w io.Writer) error {
+	_, err := w.Write([]byte{0})
+	return err
+}
+
+// parseSCPFileHeader parses the "<mode> <size> <name>" body shared by
+// both "C<mode> <size> <name>" (file) and "D<mode> 0 <name>" (directory)
+// control lines. The caller has already switched on the leading letter,
+// so it's stripped here rather than matched literally. name is taken as
+// everything after the second space rather than with %s/Fields, since
+// names containing spaces are otherwise silently truncated.
+func parseSCPFileHeader(header string) (mode os.FileMode, size int64, name string, err error) {
+	body := strings.TrimRight(header[1:], "\n")
+	parts := strings.SplitN(body, " ", 3)
+	if len(parts) != 3 {
+		err = fmt.Errorf("error parsing SCP file header %q", header)
+		return
+	}
+
+	m, perr := strconv.ParseUint(parts[0], 8, 32)
+	if perr != nil {
+		err = fmt.Errorf("error parsing SCP file header %q: %s", header, perr)
+		return
+	}
+
+	size, perr = strconv.ParseInt(parts[1], 10, 64)
+	if perr != nil {
+		err = fmt.Errorf("error parsing SCP file header %q: %s", header, perr)
+		return
+	}
+
+	mode = os.FileMode(m)
+	name = parts[2]
+	return
+}
+
+// safeSCPName rejects a remote-supplied SCP file/directory name that
+// isn't a single path element, so a malicious or compromised source
+// host can't use ".." or an embedded separator to write outside the
+// local download destination.
+func safeSCPName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\") {
+		return fmt.Errorf("unsafe SCP file name: %q", name)
 	}
 
 	return nil
 }
 
-func scpUploadDir(root string, fs []os.FileInfo, w io.Writer, r *bufio.Reader) error {
-	for _, fi := range fs {
-		if !fi.IsDir() {
-			// It is a regular file, just upload it
-			f, err := os.Open(filepath.Join(root, fi.Name()))
+// scpDownloadFile implements the sink side of the SCP protocol well
+// enough to receive a single file sent by a remote "scp -f" process: it
+// acks the "T" (timestamp) and "C" (file) control lines, streams the
+// file's bytes into dst, and verifies the trailing status byte.
+func scpDownloadFile(dst io.Writer, w io.Writer, r *bufio.Reader) error {
+	// The sink must speak first: "scp -f" blocks waiting for our initial
+	// ack before it sends its first control line.
+	if err := ack(w); err != nil {
+		return err
+	}
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+
+		switch line[0] {
+		case 'T':
+			// Timestamp line. We don't have anywhere to put this since
+			// dst is a plain io.Writer, so just ack it and keep going.
+			if err := ack(w); err != nil {
+				return err
+			}
+		case 'C':
+			_, size, _, err := parseSCPFileHeader(line)
 			if err != nil {
 				return err
 			}
 
-			err = func() error {
-				defer f.Close()
-				return scpUploadFile(fi.Name(), f, w, r)
-			}()
+			if err := ack(w); err != nil {
+				return err
+			}
 
-			if err != nil {
+			if _, err := io.CopyN(dst, r, size); err != nil {
+				return err
+			}
+
+			if err := checkSCPStatus(r); err != nil {
 				return err
 			}
+
+			return ack(w)
+		case 0x01, 0x02:
+			return errors.New(strings.TrimSpace(line[1:]))
+		default:
+			return fmt.Errorf("unexpected SCP control line: %q", line)
 		}
 	}
+}
 
-	return nil
+// scpDownloadDir implements the sink side of the SCP protocol for a
+// directory tree sent by a remote "scp -rf" process. It tracks the
+// current directory on a stack as "D"/"E" lines enter and leave
+// subdirectories, and mirrors each file it sees under dst.
+func scpDownloadDir(dst string, w io.Writer, r *bufio.Reader) error {
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return err
+	}
+
+	// The sink must speak first: "scp -rf" blocks waiting for our
+	// initial ack before it sends its first control line.
+	if err := ack(w); err != nil {
+		return err
+	}
+
+	cur := dst
+	stack := []string{}
+	for {
+		line, err := r.ReadString('\n')
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch line[0] {
+		case 'T':
+			if err := ack(w); err != nil {
+				return err
+			}
+		case 'C':
+			mode, size, name, err := parseSCPFileHeader(line)
+			if err != nil {
+				return err
+			}
+
+			if err := safeSCPName(name); err != nil {
+				return err
+			}
+
+			if err := ack(w); err != nil {
+				return err
+			}
+
+			f, err := os.OpenFile(
+				filepath.Join(cur, name), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+			if err != nil {
+				return err
+			}
+
+			_, err = io.CopyN(f, r, size)
+			f.Close()
+			if err != nil {
+				return err
+			}
+
+			if err := checkSCPStatus(r); err != nil {
+				return err
+			}
+
+			if err := ack(w); err != nil {
+				return err
+			}
+		case 'D':
+			mode, _, name, err := parseSCPFileHeader(line)
+			if err != nil {
+				return err
+			}
+
+			if err := safeSCPName(name); err != nil {
+				return err
+			}
+
+			cur = filepath.Join(cur, name)
+			if err := os.MkdirAll(cur, 0755); err != nil {
+				return err
+			}
+
+			// MkdirAll applies umask, so the directory may not actually
+			// have the mode the remote sent; set it explicitly.
+			if err := os.Chmod(cur, mode); err != nil {
+				return err
+			}
+
+			stack = append(stack, cur)
+			if err := ack(w); err != nil {
+				return err
+			}
+		case 'E':
+			if len(stack) == 0 {
+				return errors.New("unexpected SCP 'E' with no open directory")
+			}
+
+			stack = stack[:len(stack)-1]
+			if len(stack) > 0 {
+				cur = stack[len(stack)-1]
+			} else {
+				cur = dst
+			}
+
+			if err := ack(w); err != nil {
+				return err
+			}
+		case 0x01, 0x02:
+			return errors.New(strings.TrimSpace(line[1:]))
+		default:
+			return fmt.Errorf("unexpected SCP control line: %q", line)
+		}
+	}
 }
 
-func scpWalkFn(cur string, dst string, src string, w io.Writer, r *bufio.Reader) filepath.WalkFunc {
+// scpWalkFn builds a filepath.WalkFunc that uploads everything under cur
+// (a directory rooted at src) over an in-progress "scp -rt" session,
+// skipping any path whose src-relative form matches excl. Directories
+// are recursed into with their own filepath.Walk call so each one gets
+// matching "D"/"E" framing; the returned SkipDir after that recursion
+// stops the caller's own Walk from descending into it a second time.
+func scpWalkFn(cur string, src string, excl []string, w io.Writer, r *bufio.Reader) filepath.WalkFunc {
 	return func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
@@ -351,24 +827,36 @@ func scpWalkFn(cur string, dst string, src string, w io.Writer, r *bufio.Reader)
 		if err != nil {
 			return err
 		}
+		relPath = filepath.ToSlash(relPath)
+
+		if excludeMatch(relPath, excl) {
+			log.Printf("SCP: excluding %s", relPath)
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
 
-		// TODO(mitchellh): Check excludes
 		targetPath := filepath.Base(relPath)
 		if info.IsDir() {
 			log.Printf("SCP: starting directory upload: %s", targetPath)
 			fmt.Fprintln(w, "D0755 0", targetPath)
-			err := checkSCPStatus(r)
-			if err != nil {
+			if err := checkSCPStatus(r); err != nil {
 				return err
 			}
 
-			err = filepath.Walk(path, scpWalkFn(path, dst, src, w, r))
-			if err != nil {
+			if err := filepath.Walk(path, scpWalkFn(path, src, excl, w, r)); err != nil {
 				return err
 			}
 
 			fmt.Fprintln(w, "E")
-			return checkSCPStatus(r)
+			if err := checkSCPStatus(r); err != nil {
+				return err
+			}
+
+			// We already recursed into path's subtree above; tell the
+			// caller's Walk not to descend into it again.
+			return filepath.SkipDir
 		}
 
 		// Open the file for uploading
@@ -379,7 +867,6 @@ func scpWalkFn(cur string, dst string, src string, w io.Writer, r *bufio.Reader)
 		defer f.Close()
 
 		// Upload the file like any normal SCP operation
-		targetPath = filepath.Base(relPath)
-		return scpUploadFile(targetPath, f, w, r)
+		return scpUploadFile(targetPath, f, w, r, &info)
 	}
 }
@@ -0,0 +1,222 @@
+package ssh
+
+import (
+	"code.google.com/p/go.crypto/ssh"
+	"fmt"
+	"github.com/pkg/sftp"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// newSftpSession opens a new SSH session and starts the "sftp" subsystem
+// on it, returning an sftp.Client wired up on top. The caller is
+// responsible for closing both the returned client and session.
+func (c *comm) newSftpSession() (*sftp.Client, *ssh.Session, error) {
+	session, err := c.newSession()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := session.RequestSubsystem("sftp"); err != nil {
+		session.Close()
+		return nil, nil, err
+	}
+
+	stdinW, err := session.StdinPipe()
+	if err != nil {
+		session.Close()
+		return nil, nil, err
+	}
+
+	stdoutPipe, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		return nil, nil, err
+	}
+
+	client, err := sftp.NewClientPipe(stdoutPipe, stdinW)
+	if err != nil {
+		session.Close()
+		return nil, nil, err
+	}
+
+	return client, session, nil
+}
+
+func (c *comm) sftpUpload(dst string, src io.Reader, fi *os.FileInfo) error {
+	client, session, err := c.newSftpSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	defer client.Close()
+
+	return sftpUploadFile(dst, src, client, fi)
+}
+
+// sftpUploadFile uploads src as dst via client, preserving mode and
+// mtime from fi when it's provided.
+func sftpUploadFile(dst string, src io.Reader, client *sftp.Client, fi *os.FileInfo) error {
+	log.Printf("Uploading file to '%s' via sftp", dst)
+
+	if err := client.MkdirAll(path.Dir(filepath.ToSlash(dst))); err != nil {
+		return err
+	}
+
+	f, err := client.Create(dst)
+	if err != nil {
+		return fmt.Errorf("error creating file %q: %s", dst, err)
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, src); err != nil {
+		return err
+	}
+
+	if fi == nil {
+		return nil
+	}
+
+	info := *fi
+	if err := client.Chmod(dst, info.Mode().Perm()); err != nil {
+		log.Printf("[WARN] sftp: failed to set mode on %q: %s", dst, err)
+	}
+
+	if err := client.Chtimes(dst, info.ModTime(), info.ModTime()); err != nil {
+		log.Printf("[WARN] sftp: failed to set mtime on %q: %s", dst, err)
+	}
+
+	return nil
+}
+
+func (c *comm) sftpUploadDir(dst string, src string, excl []string) error {
+	client, session, err := c.newSftpSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	defer client.Close()
+
+	return filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if p == src {
+			return nil
+		}
+
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		if excludeMatch(rel, excl) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		target := path.Join(dst, rel)
+		if info.IsDir() {
+			return client.MkdirAll(target)
+		}
+
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		return sftpUploadFile(target, f, client, &info)
+	})
+}
+
+func (c *comm) sftpDownload(src string, dst io.Writer) error {
+	client, session, err := c.newSftpSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	defer client.Close()
+
+	f, err := client.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(dst, f)
+	return err
+}
+
+func (c *comm) sftpDownloadDir(src string, dst string) error {
+	client, session, err := c.newSftpSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	defer client.Close()
+
+	walker := client.Walk(src)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, walker.Path())
+		if err != nil {
+			return err
+		}
+
+		target := filepath.Join(dst, rel)
+		info := walker.Stat()
+		if info.IsDir() {
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+			if err := os.Chmod(target, info.Mode().Perm()); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := sftpDownloadFile(target, walker.Path(), client); err != nil {
+			return err
+		}
+
+		if err := os.Chmod(target, info.Mode().Perm()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func sftpDownloadFile(dst string, src string, client *sftp.Client) error {
+	log.Printf("Downloading file from '%s' via sftp", src)
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+
+	f, err := client.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, f)
+	return err
+}